@@ -0,0 +1,95 @@
+// Package config reads the .pganalyze_collector.conf configuration file and
+// exposes the per-database settings the collector needs in order to connect
+// and submit snapshots.
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/gcfg.v1"
+)
+
+// ReplicaReadModeAny - Read from any configured replica, regardless of how
+// far behind the primary it currently is
+const ReplicaReadModeAny = "any"
+
+// ReplicaReadModeStrict - Only read from a replica once it has caught up to
+// the LSN observed on the primary at the start of the collection run
+const ReplicaReadModeStrict = "strict"
+
+// DatabaseConfig - Configuration for a single monitored database, as read
+// from one section of the collector's configuration file
+type DatabaseConfig struct {
+	SectionName string
+
+	DbHost     string
+	DbPort     int
+	DbName     string
+	DbUsername string
+	DbPassword string
+	DbSslMode  string
+
+	// DbReplicas - DSNs of read replicas that read-only collection queries
+	// may be routed to instead of the primary
+	DbReplicas []string
+
+	// ReplicaReadMode - Either ReplicaReadModeAny or ReplicaReadModeStrict
+	ReplicaReadMode string
+
+	APIKey string
+	APIURL string
+
+	// SubmitterTransport - Which SnapshotSubmitter to deliver snapshots with:
+	// "api" (default, the pganalyze HTTP endpoint), "s3", "gcs", or "local"
+	SubmitterTransport string
+	SubmitterBucket    string
+	SubmitterRegion    string
+	SpoolDirectory     string
+	QueueDirectory     string
+
+	// DataCompressor - Either "zlib" (default) or "zstd"
+	DataCompressor string
+
+	// PoolMinConns/PoolMaxConns - Bounds on the pgx connection pool kept open
+	// across scheduler ticks, instead of reconnecting on every collection
+	PoolMinConns int
+	PoolMaxConns int
+
+	// StatementCacheCapacity - Number of prepared statements pgx caches per connection
+	StatementCacheCapacity int
+
+	// SchemaDiffDirectory - Where the last successfully collected schema is
+	// persisted, so it can be diffed against on the next run
+	SchemaDiffDirectory string
+
+	// SchemaDiffAuditLog - Local audit log that each detected schema change is appended to
+	SchemaDiffAuditLog string
+}
+
+type configFile struct {
+	Pganalyze map[string]*DatabaseConfig
+}
+
+// GetConnectionString - Builds a connection string for this database, suitable
+// for pgxpool.ParseConfig
+func (c DatabaseConfig) GetConnectionString() string {
+	return fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
+		c.DbHost, c.DbPort, c.DbName, c.DbUsername, c.DbPassword, c.DbSslMode)
+}
+
+// Read - Parses the collector configuration file, returning one DatabaseConfig per section
+func Read(filename string) (configs []DatabaseConfig, err error) {
+	var cf configFile
+
+	err = gcfg.ReadFileInto(&cf, filename)
+	if err != nil {
+		return
+	}
+
+	for sectionName, dbConfig := range cf.Pganalyze {
+		dbConfig.SectionName = sectionName
+		configs = append(configs, *dbConfig)
+	}
+
+	return
+}
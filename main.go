@@ -3,12 +3,11 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"os/user"
@@ -17,17 +16,19 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/klauspost/compress/zstd"
 	flag "github.com/ogier/pflag"
 
-	"database/sql"
-
-	_ "github.com/lib/pq" // Enable database package to use Postgres
-
 	"github.com/pganalyze/collector/config"
 	"github.com/pganalyze/collector/dbstats"
 	"github.com/pganalyze/collector/explain"
 	"github.com/pganalyze/collector/logs"
 	scheduler "github.com/pganalyze/collector/scheduler"
+	"github.com/pganalyze/collector/schemadiff"
+	"github.com/pganalyze/collector/setup"
+	"github.com/pganalyze/collector/submitter"
 	systemstats "github.com/pganalyze/collector/systemstats"
 	"github.com/pganalyze/collector/util"
 )
@@ -39,6 +40,7 @@ type snapshot struct {
 	System        *systemstats.SystemSnapshot `json:"system"`
 	Logs          []logs.Line                 `json:"logs"`
 	Explains      []explain.Explain           `json:"explains"`
+	SchemaChanges *schemadiff.Diff            `json:"schema_changes,omitempty"`
 }
 
 type snapshotPostgres struct {
@@ -47,6 +49,25 @@ type snapshotPostgres struct {
 	Functions []dbstats.Function `json:"functions"`
 }
 
+// RevisionUnavailableError - Describes a replica that has not yet replayed
+// far enough to be used for a strict-mode read. chooseReadConnection logs it
+// and falls back to the next replica, or ultimately the primary; it is not
+// returned to the caller.
+type RevisionUnavailableError struct {
+	TargetLsn  string
+	ReplicaLsn string
+}
+
+func (e RevisionUnavailableError) Error() string {
+	return fmt.Sprintf("replica has not caught up to required LSN %s (currently at %s)", e.TargetLsn, e.ReplicaLsn)
+}
+
+// replicaReadModeStrict mirrors config.ReplicaReadModeStrict: collectStatistics
+// takes its DatabaseConfig as a parameter named "config", which shadows the
+// config package within that function, so the exported constant can't be
+// referenced there directly.
+const replicaReadModeStrict = config.ReplicaReadModeStrict
+
 type collectionOpts struct {
 	collectPostgresRelations bool
 	collectPostgresSettings  bool
@@ -63,24 +84,28 @@ type collectionOpts struct {
 	testRun             bool
 }
 
-func collectStatistics(config config.DatabaseConfig, db *sql.DB, collectionOpts collectionOpts, logger *util.Logger) (err error) {
+func collectStatistics(config config.DatabaseConfig, db *pgxpool.Pool, replicas []*pgxpool.Pool, snapshotSubmitter submitter.RetryingSubmitter, collectionOpts collectionOpts, logger *util.Logger) (err error) {
 	var stats snapshot
 	var explainInputs []explain.ExplainInput
 	var postgresVersion string
 	var postgresVersionReadable string
 	var postgresVersionNum int
+	var readDB *pgxpool.Pool
+	var targetLsn string
+
+	ctx := context.Background()
 
-	err = db.QueryRow(dbstats.QueryMarkerSQL + "SELECT version()").Scan(&postgresVersion)
+	err = db.QueryRow(ctx, dbstats.QueryMarkerSQL+"SELECT version()").Scan(&postgresVersion)
 	if err != nil {
 		return
 	}
 
-	err = db.QueryRow(dbstats.QueryMarkerSQL + "SHOW server_version").Scan(&postgresVersionReadable)
+	err = db.QueryRow(ctx, dbstats.QueryMarkerSQL+"SHOW server_version").Scan(&postgresVersionReadable)
 	if err != nil {
 		return
 	}
 
-	err = db.QueryRow(dbstats.QueryMarkerSQL + "SHOW server_version_num").Scan(&postgresVersionNum)
+	err = db.QueryRow(ctx, dbstats.QueryMarkerSQL+"SHOW server_version_num").Scan(&postgresVersionNum)
 	if err != nil {
 		return
 	}
@@ -92,37 +117,100 @@ func collectStatistics(config config.DatabaseConfig, db *sql.DB, collectionOpts
 		return
 	}
 
-	stats.ActiveQueries, err = dbstats.GetActivity(logger, db, postgresVersionNum)
+	// The per-database reads below run inside a REPEATABLE READ, READ ONLY
+	// transaction on the primary so they observe one consistent MVCC snapshot,
+	// instead of each query racing against concurrent writes on its own
+	// connection. Reads routed to a replica use a second such transaction on
+	// that replica (see below).
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	stats.ActiveQueries, err = dbstats.GetActivity(logger, tx, postgresVersionNum)
+	if err != nil {
+		return
+	}
+
+	if len(replicas) > 0 && config.ReplicaReadMode == replicaReadModeStrict {
+		err = tx.QueryRow(ctx, dbstats.QueryMarkerSQL+"SELECT pg_current_wal_lsn()::text").Scan(&targetLsn)
+		if err != nil {
+			return
+		}
+	}
+
+	readDB, err = chooseReadConnection(ctx, db, replicas, config.ReplicaReadMode, targetLsn, logger)
 	if err != nil {
 		return
 	}
 
-	stats.Statements, err = dbstats.GetStatements(logger, db, postgresVersionNum)
+	// We'd like every read below to observe one consistent snapshot, but
+	// pg_export_snapshot()/SET TRANSACTION SNAPSHOT only works between
+	// sessions on the same server - an exported snapshot is backed by a file
+	// in that server's own pg_snapshots/ directory, which isn't replicated,
+	// so it doesn't exist once readDB is an actual streaming replica. When
+	// reading from a replica we accept its own independent (but still
+	// REPEATABLE READ) snapshot instead of trying to pin it to the primary's.
+	readTx := tx
+	if readDB != db {
+		readTx, err = readDB.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			return
+		}
+		defer readTx.Rollback(ctx)
+	}
+
+	stats.Statements, err = dbstats.GetStatements(logger, readTx, postgresVersionNum)
 	if err != nil {
 		return
 	}
 
 	if collectionOpts.collectPostgresRelations {
-		stats.Postgres.Relations, err = dbstats.GetRelations(db, postgresVersionNum, collectionOpts.collectPostgresBloat)
+		stats.Postgres.Relations, err = dbstats.GetRelations(readTx, postgresVersionNum, collectionOpts.collectPostgresBloat)
 		if err != nil {
 			return
 		}
 	}
 
 	if collectionOpts.collectPostgresSettings {
-		stats.Postgres.Settings, err = dbstats.GetSettings(db, postgresVersionNum)
+		stats.Postgres.Settings, err = dbstats.GetSettings(readTx, postgresVersionNum)
 		if err != nil {
 			return
 		}
 	}
 
 	if collectionOpts.collectPostgresFunctions {
-		stats.Postgres.Functions, err = dbstats.GetFunctions(db, postgresVersionNum)
+		stats.Postgres.Functions, err = dbstats.GetFunctions(readTx, postgresVersionNum)
+		if err != nil {
+			return
+		}
+	}
+
+	var databaseOid int
+	if collectionOpts.collectPostgresRelations && collectionOpts.collectPostgresSettings && collectionOpts.collectPostgresFunctions {
+		err = tx.QueryRow(ctx, dbstats.QueryMarkerSQL+"SELECT oid FROM pg_database WHERE datname = current_database()").Scan(&databaseOid)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return
+	}
+
+	if readTx != tx {
+		err = readTx.Commit(ctx)
 		if err != nil {
 			return
 		}
 	}
 
+	if databaseOid != 0 {
+		stats.SchemaChanges = computeSchemaChanges(config, databaseOid, stats.Postgres, logger)
+	}
+
 	if collectionOpts.collectSystemInformation {
 		stats.System = systemstats.GetSystemSnapshot(config)
 	}
@@ -145,34 +233,22 @@ func collectStatistics(config config.DatabaseConfig, db *sql.DB, collectionOpts
 		return
 	}
 
-	var compressedJSON bytes.Buffer
-	w := zlib.NewWriter(&compressedJSON)
-	w.Write(statsJSON)
-	w.Close()
-
-	resp, err := http.PostForm(config.APIURL, url.Values{
-		"data":               {compressedJSON.String()},
-		"data_compressor":    {"zlib"},
-		"api_key":            {config.APIKey},
-		"submitter":          {"pganalyze-collector 0.9.0rc2"},
-		"system_information": {"false"},
-		"no_reset":           {"true"},
-		"query_source":       {"pg_stat_statements"},
-		"collected_at":       {fmt.Sprintf("%d", time.Now().Unix())},
-	})
-	// TODO: We could consider re-running on error (e.g. if it was a temporary server issue)
-	if err != nil {
-		return
+	dataCompressor := config.DataCompressor
+	if dataCompressor == "" {
+		dataCompressor = "zlib"
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	compressedJSON, err := compressSnapshot(statsJSON, dataCompressor)
 	if err != nil {
 		return
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Error when submitting: %s\n", body)
+	err = snapshotSubmitter.Submit(ctx, compressedJSON, submitter.SubmissionMeta{
+		ServerID:       config.SectionName,
+		CollectedAt:    time.Now().Unix(),
+		DataCompressor: dataCompressor,
+	})
+	if err != nil {
 		return
 	}
 
@@ -180,53 +256,261 @@ func collectStatistics(config config.DatabaseConfig, db *sql.DB, collectionOpts
 	return
 }
 
+// computeSchemaChanges - Diffs the just-collected schema against the last
+// successfully persisted one for this server/database, logging the diff to
+// the local audit log and persisting the current schema for next time
+func computeSchemaChanges(config config.DatabaseConfig, databaseOid int, postgres snapshotPostgres, logger *util.Logger) *schemadiff.Diff {
+	schemaDiffDir := config.SchemaDiffDirectory
+	if schemaDiffDir == "" {
+		schemaDiffDir = "/tmp/pganalyze-collector-schemadiff"
+	}
+
+	auditLogPath := config.SchemaDiffAuditLog
+	if auditLogPath == "" {
+		auditLogPath = schemaDiffDir + "/audit.log"
+	}
+
+	current := schemadiff.Schema{Relations: postgres.Relations, Functions: postgres.Functions, Settings: postgres.Settings}
+
+	var result *schemadiff.Diff
+
+	previous, found, err := schemadiff.Load(schemaDiffDir, config.SectionName, databaseOid)
+	if err != nil {
+		logger.PrintError("Error: Could not load previous schema snapshot: %s", err)
+	} else if found {
+		diff := schemadiff.Compute(previous, current)
+		if !diff.IsEmpty() {
+			result = &diff
+
+			err = schemadiff.AppendAuditLog(auditLogPath, config.SectionName, databaseOid, diff)
+			if err != nil {
+				logger.PrintError("Error: Could not write schema diff audit log: %s", err)
+			}
+		}
+	}
+
+	err = schemadiff.Save(schemaDiffDir, config.SectionName, databaseOid, current)
+	if err != nil {
+		logger.PrintError("Error: Could not persist schema snapshot: %s", err)
+	}
+
+	return result
+}
+
+// compressSnapshot - Compresses the snapshot JSON with the negotiated
+// data_compressor, either the long-standing "zlib" or the newer, faster "zstd"
+func compressSnapshot(statsJSON []byte, dataCompressor string) ([]byte, error) {
+	var compressed bytes.Buffer
+
+	if dataCompressor == "zstd" {
+		w, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(statsJSON)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return compressed.Bytes(), nil
+	}
+
+	w := zlib.NewWriter(&compressed)
+	w.Write(statsJSON)
+	w.Close()
+	return compressed.Bytes(), nil
+}
+
+// newSubmitter - Builds the configured SnapshotSubmitter, wrapped with
+// retry/backoff and a persistent on-disk queue so transient failures are
+// retried instead of dropped
+func newSubmitter(config config.DatabaseConfig, logger *util.Logger) (submitter.RetryingSubmitter, error) {
+	var inner submitter.SnapshotSubmitter
+	var err error
+
+	queueDir := config.QueueDirectory
+	if queueDir == "" {
+		queueDir = "/tmp/pganalyze-collector-queue/" + config.SectionName
+	}
+
+	switch config.SubmitterTransport {
+	case "s3":
+		inner, err = submitter.NewS3Submitter(config.SubmitterBucket, config.SubmitterRegion)
+	case "gcs":
+		inner, err = submitter.NewGCSSubmitter(context.Background(), config.SubmitterBucket)
+	case "local":
+		inner = submitter.LocalSpoolSubmitter{Directory: config.SpoolDirectory}
+	default:
+		inner = submitter.HTTPSubmitter{APIURL: config.APIURL, APIKey: config.APIKey}
+	}
+	if err != nil {
+		return submitter.RetryingSubmitter{}, err
+	}
+
+	return submitter.NewRetryingSubmitter(inner, queueDir, logger), nil
+}
+
+// chooseReadConnection - Picks the connection that read-only collection
+// queries should run against. In "any" mode this is the first replica that
+// responds, falling back to the next one (and ultimately the primary) when a
+// replica is unreachable; in "strict" mode each replica must additionally be
+// confirmed to have replayed up to targetLsn, falling back the same way when
+// a RevisionUnavailableError is encountered.
+func chooseReadConnection(ctx context.Context, primary *pgxpool.Pool, replicas []*pgxpool.Pool, mode string, targetLsn string, logger *util.Logger) (*pgxpool.Pool, error) {
+	if len(replicas) == 0 {
+		return primary, nil
+	}
+
+	if mode != config.ReplicaReadModeStrict {
+		for _, replica := range replicas {
+			if err := replica.Ping(ctx); err != nil {
+				logger.PrintVerbose("Could not reach replica: %s", err)
+				continue
+			}
+			return replica, nil
+		}
+
+		logger.PrintVerbose("No replica is reachable, falling back to primary")
+		return primary, nil
+	}
+
+	for _, replica := range replicas {
+		var replicaLsn string
+		var caughtUp bool
+
+		err := replica.QueryRow(ctx, dbstats.QueryMarkerSQL+"SELECT pg_last_wal_replay_lsn()::text, pg_last_wal_replay_lsn() >= $1::pg_lsn", targetLsn).Scan(&replicaLsn, &caughtUp)
+		if err != nil {
+			logger.PrintVerbose("Could not check replication state on replica: %s", err)
+			continue
+		}
+
+		if caughtUp {
+			return replica, nil
+		}
+
+		logger.PrintVerbose("%s", RevisionUnavailableError{TargetLsn: targetLsn, ReplicaLsn: replicaLsn})
+	}
+
+	logger.PrintVerbose("No replica has caught up to LSN %s, falling back to primary", targetLsn)
+	return primary, nil
+}
+
 func collectAllDatabases(databases []configAndConnection, globalCollectionOpts collectionOpts, logger *util.Logger) {
 	for _, database := range databases {
 		prefixedLogger := logger.WithPrefix(database.config.SectionName)
-		err := collectStatistics(database.config, database.connection, globalCollectionOpts, prefixedLogger)
+
+		err := database.submitter.RetryQueued(context.Background())
+		if err != nil {
+			prefixedLogger.PrintError("Error retrying queued submissions: %s", err)
+		}
+
+		err = collectStatistics(database.config, database.connection, database.replicaConnections, database.submitter, globalCollectionOpts, prefixedLogger)
 		if err != nil {
 			prefixedLogger.PrintError("%s", err)
 		}
 	}
 }
 
-func connectToDb(config config.DatabaseConfig, logger *util.Logger) (*sql.DB, error) {
-	connectString := config.GetPqOpenString()
-	logger.PrintVerbose("sql.Open(\"postgres\", \"%s\")", connectString)
+func buildPoolConfig(config config.DatabaseConfig, connString string) (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PoolMinConns > 0 {
+		poolConfig.MinConns = int32(config.PoolMinConns)
+	}
+	if config.PoolMaxConns > 0 {
+		poolConfig.MaxConns = int32(config.PoolMaxConns)
+	}
+	if config.StatementCacheCapacity > 0 {
+		poolConfig.ConnConfig.StatementCacheCapacity = config.StatementCacheCapacity
+	}
+
+	return poolConfig, nil
+}
+
+func connectToDb(ctx context.Context, config config.DatabaseConfig, logger *util.Logger) (*pgxpool.Pool, error) {
+	connectString := config.GetConnectionString()
+	logger.PrintVerbose("pgxpool.NewWithConfig(\"%s\")", connectString)
+
+	poolConfig, err := buildPoolConfig(config, connectString)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := sql.Open("postgres", connectString)
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	err = db.Ping()
+	err = pool.Ping(ctx)
 	if err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	return db, nil
+	return pool, nil
 }
 
 type configAndConnection struct {
-	config     config.DatabaseConfig
-	connection *sql.DB
+	config             config.DatabaseConfig
+	connection         *pgxpool.Pool
+	replicaConnections []*pgxpool.Pool
+	submitter          submitter.RetryingSubmitter
+}
+
+func connectToReplica(ctx context.Context, config config.DatabaseConfig, dsn string, logger *util.Logger) (*pgxpool.Pool, error) {
+	logger.PrintVerbose("pgxpool.NewWithConfig(\"%s\") [replica]", dsn)
+
+	poolConfig, err := buildPoolConfig(config, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pool.Ping(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
 }
 
 func establishConnection(config config.DatabaseConfig, logger *util.Logger) (database configAndConnection, err error) {
 	database = configAndConnection{config: config}
-	requestedSslMode := config.DbSslMode
+	ctx := context.Background()
 
-	// Go's lib/pq does not support sslmode properly, so we have to implement the "prefer" mode ourselves
-	if requestedSslMode == "prefer" {
-		config.DbSslMode = "require"
+	// pgx negotiates "sslmode=prefer" natively, so unlike the old lib/pq based
+	// connection logic we no longer need to retry the connection ourselves.
+	database.connection, err = connectToDb(ctx, config, logger)
+	if err != nil {
+		return
 	}
 
-	database.connection, err = connectToDb(config, logger)
-	if err != nil {
-		if err.Error() == "pq: SSL is not enabled on the server" && requestedSslMode == "prefer" {
-			config.DbSslMode = "disable"
-			database.connection, err = connectToDb(config, logger)
+	for _, replicaDSN := range config.DbReplicas {
+		replicaConnection, replicaErr := connectToReplica(ctx, config, replicaDSN, logger)
+		if replicaErr != nil {
+			logger.PrintError("Error: Failed to connect to replica: %s", replicaErr)
+			continue
 		}
+		database.replicaConnections = append(database.replicaConnections, replicaConnection)
+	}
+
+	// Built once here and reused across every scheduler tick, so s3/gcs
+	// transports aren't re-establishing a session/client on every collection.
+	database.submitter, err = newSubmitter(config, logger)
+	if err != nil {
+		return
 	}
 
 	return
@@ -273,6 +557,36 @@ func run(wg sync.WaitGroup, globalCollectionOpts collectionOpts, logger *util.Lo
 	return stop
 }
 
+// runSetup - Entry point for the "collector setup" subcommand, which walks
+// the user through preparing a database and host for monitoring instead of
+// running the regular collection loop.
+func runSetup(logger *util.Logger, args []string, defaultConfigFilename string) {
+	setupFlags := flag.NewFlagSet("setup", flag.ExitOnError)
+	configFilename := setupFlags.String("config", defaultConfigFilename, "Specify alternative path for config file.")
+	setupFlags.BoolVar(&logger.Verbose, "verbose", false, "Outputs additional debugging information, use this if you're encoutering errors or other problems.")
+	setupFlags.Parse(args)
+
+	databaseConfigs, err := config.Read(*configFilename)
+	if err != nil || len(databaseConfigs) == 0 {
+		databaseConfigs = []config.DatabaseConfig{{SectionName: "pganalyze"}}
+	}
+
+	cfg := databaseConfigs[0]
+	prefixedLogger := logger.WithPrefix(cfg.SectionName)
+
+	database, err := establishConnection(cfg, prefixedLogger)
+	if err != nil {
+		prefixedLogger.PrintError("Error: Failed to connect to database: %s", err)
+		return
+	}
+	defer database.connection.Close()
+
+	err = setup.Run(prefixedLogger, cfg, database.connection, *configFilename)
+	if err != nil {
+		prefixedLogger.PrintError("%s", err)
+	}
+}
+
 func main() {
 	var dryRun bool
 	var testRun bool
@@ -289,6 +603,11 @@ func main() {
 		return
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		runSetup(logger, os.Args[2:], usr.HomeDir+"/.pganalyze_collector.conf")
+		return
+	}
+
 	flag.BoolVarP(&testRun, "test", "t", false, "Tests whether we can successfully collect data, submits it to the server, and exits afterwards.")
 	flag.BoolVarP(&logger.Verbose, "verbose", "v", false, "Outputs additional debugging information, use this if you're encoutering errors or other problems.")
 	flag.BoolVar(&dryRun, "dry-run", false, "Print JSON data that would get sent to web service (without actually sending) and exit afterwards.")
@@ -0,0 +1,41 @@
+package schemadiff
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type auditEntry struct {
+	OccurredAt time.Time `json:"occurred_at"`
+	ServerID   string    `json:"server_id"`
+	Database   int       `json:"database_oid"`
+	Diff       Diff      `json:"diff"`
+}
+
+// AppendAuditLog - Appends a single JSON line describing diff to the local
+// schema-change audit log at path, creating it if necessary
+func AppendAuditLog(path string, serverID string, databaseOid int, diff Diff) error {
+	// The audit log records the diffed schema/function definitions, so keep
+	// both the directory and the file readable only by the user running the
+	// collector.
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(auditEntry{OccurredAt: time.Now(), ServerID: serverID, Database: databaseOid, Diff: diff})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
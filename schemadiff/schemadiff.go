@@ -0,0 +1,196 @@
+// Package schemadiff tracks DDL changes between successive collector
+// snapshots by persisting the last successfully collected schema to disk and
+// diffing it against the current one.
+package schemadiff
+
+import (
+	"reflect"
+
+	"github.com/pganalyze/collector/dbstats"
+)
+
+// Schema - The portion of a snapshot that schemadiff persists and compares
+// across collection runs
+type Schema struct {
+	Relations []dbstats.Relation `json:"relations"`
+	Functions []dbstats.Function `json:"functions"`
+	Settings  []dbstats.Setting  `json:"settings"`
+}
+
+// Change - The before/after value of a single altered relation or function,
+// or of a changed setting. Added and removed items are listed by key only.
+type Change struct {
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Diff - A structured description of what changed between two Schemas
+type Diff struct {
+	AddedRelations   []string          `json:"added_relations,omitempty"`
+	RemovedRelations []string          `json:"removed_relations,omitempty"`
+	AlteredRelations map[string]Change `json:"altered_relations,omitempty"`
+
+	AddedFunctions   []string          `json:"added_functions,omitempty"`
+	RemovedFunctions []string          `json:"removed_functions,omitempty"`
+	AlteredFunctions map[string]Change `json:"altered_functions,omitempty"`
+
+	ChangedSettings map[string]Change `json:"changed_settings,omitempty"`
+}
+
+// IsEmpty - True when nothing changed between the two Schemas
+func (d Diff) IsEmpty() bool {
+	return len(d.AddedRelations) == 0 && len(d.RemovedRelations) == 0 && len(d.AlteredRelations) == 0 &&
+		len(d.AddedFunctions) == 0 && len(d.RemovedFunctions) == 0 && len(d.AlteredFunctions) == 0 &&
+		len(d.ChangedSettings) == 0
+}
+
+// liveStatFieldNames - the dbstats.Relation/dbstats.Function fields that hold
+// live statistics (row/index counts, sizes, call counts, ...) rather than
+// DDL-relevant definition data. Only fields named here are ignored when
+// diffing schemas, so a genuinely numeric DDL attribute - a column's
+// length/precision modifier, its ordinal position, the number of columns in
+// an index, etc. - still participates in the comparison.
+var liveStatFieldNames = map[string]bool{
+	"SizeBytes":      true,
+	"ToastSizeBytes": true,
+	"EstimatedRows":  true,
+	"SeqScans":       true,
+	"SeqTupRead":     true,
+	"IndexScans":     true,
+	"IndexTupFetch":  true,
+	"RowsInserted":   true,
+	"RowsUpdated":    true,
+	"RowsDeleted":    true,
+	"RowsHotUpdated": true,
+	"LiveTuples":     true,
+	"DeadTuples":     true,
+	"Calls":          true,
+	"TotalTime":      true,
+	"SelfTime":       true,
+}
+
+// schemaFingerprint returns a copy of v with every field named in
+// liveStatFieldNames zeroed out, recursively. dbstats.Relation and
+// dbstats.Function carry live statistics alongside their DDL-relevant
+// fields, and those statistics change on virtually every collection even
+// when there's been no schema change at all. Comparing fingerprints instead
+// of the raw structs means Compute only reacts to actual DDL changes.
+func schemaFingerprint(v interface{}) interface{} {
+	stripped := reflect.New(reflect.TypeOf(v)).Elem()
+	stripped.Set(reflect.ValueOf(v))
+	stripLiveStatFields(stripped)
+	return stripped.Interface()
+}
+
+func stripLiveStatFields(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			// Point at a private copy, so the caller's value isn't zeroed too
+			copied := reflect.New(v.Elem().Type())
+			copied.Elem().Set(v.Elem())
+			v.Set(copied)
+			stripLiveStatFields(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && !v.IsNil() {
+			// A slice shares its backing array with the caller's value
+			copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(copied, v)
+			v.Set(copied)
+		}
+		for i := 0; i < v.Len(); i++ {
+			stripLiveStatFields(v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			if liveStatFieldNames[t.Field(i).Name] {
+				field.Set(reflect.Zero(field.Type()))
+				continue
+			}
+			stripLiveStatFields(field)
+		}
+	}
+}
+
+func relationKey(r dbstats.Relation) string {
+	return r.SchemaName + "." + r.RelationName
+}
+
+func functionKey(f dbstats.Function) string {
+	return f.SchemaName + "." + f.FunctionName
+}
+
+// Compute - Diffs two schema snapshots, reporting which relations and
+// functions were added, removed, or altered between them, and which settings
+// present in both changed. Settings that appear in only one of the two
+// snapshots are not reported.
+func Compute(previous, current Schema) Diff {
+	diff := Diff{
+		AlteredRelations: map[string]Change{},
+		AlteredFunctions: map[string]Change{},
+		ChangedSettings:  map[string]Change{},
+	}
+
+	previousRelations := make(map[string]dbstats.Relation, len(previous.Relations))
+	for _, r := range previous.Relations {
+		previousRelations[relationKey(r)] = r
+	}
+	currentRelations := make(map[string]dbstats.Relation, len(current.Relations))
+	for _, r := range current.Relations {
+		currentRelations[relationKey(r)] = r
+	}
+	for key, r := range currentRelations {
+		previousRelation, existed := previousRelations[key]
+		if !existed {
+			diff.AddedRelations = append(diff.AddedRelations, key)
+		} else if !reflect.DeepEqual(schemaFingerprint(previousRelation), schemaFingerprint(r)) {
+			diff.AlteredRelations[key] = Change{Before: previousRelation, After: r}
+		}
+	}
+	for key, r := range previousRelations {
+		if _, stillExists := currentRelations[key]; !stillExists {
+			diff.RemovedRelations = append(diff.RemovedRelations, key)
+		}
+	}
+
+	previousFunctions := make(map[string]dbstats.Function, len(previous.Functions))
+	for _, f := range previous.Functions {
+		previousFunctions[functionKey(f)] = f
+	}
+	currentFunctions := make(map[string]dbstats.Function, len(current.Functions))
+	for _, f := range current.Functions {
+		currentFunctions[functionKey(f)] = f
+	}
+	for key, f := range currentFunctions {
+		previousFunction, existed := previousFunctions[key]
+		if !existed {
+			diff.AddedFunctions = append(diff.AddedFunctions, key)
+		} else if !reflect.DeepEqual(schemaFingerprint(previousFunction), schemaFingerprint(f)) {
+			diff.AlteredFunctions[key] = Change{Before: previousFunction, After: f}
+		}
+	}
+	for key, f := range previousFunctions {
+		if _, stillExists := currentFunctions[key]; !stillExists {
+			diff.RemovedFunctions = append(diff.RemovedFunctions, key)
+		}
+	}
+
+	previousSettings := make(map[string]dbstats.Setting, len(previous.Settings))
+	for _, s := range previous.Settings {
+		previousSettings[s.Name] = s
+	}
+	for _, s := range current.Settings {
+		previousSetting, existed := previousSettings[s.Name]
+		if existed && !reflect.DeepEqual(previousSetting, s) {
+			diff.ChangedSettings[s.Name] = Change{Before: previousSetting.CurrentValue, After: s.CurrentValue}
+		}
+	}
+
+	return diff
+}
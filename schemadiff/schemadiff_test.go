@@ -0,0 +1,83 @@
+package schemadiff
+
+import (
+	"testing"
+
+	"github.com/pganalyze/collector/dbstats"
+)
+
+func TestDiffIsEmpty(t *testing.T) {
+	if !(Diff{}).IsEmpty() {
+		t.Fatal("expected zero-value Diff to be empty")
+	}
+
+	nonEmpty := Diff{AddedRelations: []string{"public.users"}}
+	if nonEmpty.IsEmpty() {
+		t.Fatal("expected Diff with an added relation to be non-empty")
+	}
+}
+
+func TestComputeDetectsAddedAndRemovedRelations(t *testing.T) {
+	previous := Schema{Relations: []dbstats.Relation{
+		{SchemaName: "public", RelationName: "users"},
+	}}
+	current := Schema{Relations: []dbstats.Relation{
+		{SchemaName: "public", RelationName: "orders"},
+	}}
+
+	diff := Compute(previous, current)
+
+	if len(diff.AddedRelations) != 1 || diff.AddedRelations[0] != "public.orders" {
+		t.Fatalf("expected public.orders to be added, got %v", diff.AddedRelations)
+	}
+	if len(diff.RemovedRelations) != 1 || diff.RemovedRelations[0] != "public.users" {
+		t.Fatalf("expected public.users to be removed, got %v", diff.RemovedRelations)
+	}
+}
+
+func TestComputeDetectsChangedSettings(t *testing.T) {
+	previous := Schema{Settings: []dbstats.Setting{{Name: "work_mem", CurrentValue: "4MB"}}}
+	current := Schema{Settings: []dbstats.Setting{{Name: "work_mem", CurrentValue: "8MB"}}}
+
+	diff := Compute(previous, current)
+
+	change, ok := diff.ChangedSettings["work_mem"]
+	if !ok {
+		t.Fatal("expected work_mem to be reported as changed")
+	}
+	if change.Before != "4MB" || change.After != "8MB" {
+		t.Fatalf("unexpected change values: %+v", change)
+	}
+}
+
+// stripLiveStatFields is the mechanism schemaFingerprint relies on to ignore
+// live-stats counters when diffing relations/functions. Test it directly
+// against a local struct, since we don't control which fields dbstats.Relation
+// happens to carry. It must only zero fields named in liveStatFieldNames -
+// any other numeric field (e.g. a DDL attribute like ordinal position or a
+// column's precision modifier) has to keep participating in the comparison.
+func TestStripLiveStatFieldsIgnoresOnlyKnownStatFields(t *testing.T) {
+	type nested struct {
+		SizeBytes int64
+	}
+	type example struct {
+		Name            string
+		OrdinalPosition int
+		Nested          nested
+	}
+
+	a := example{Name: "t", OrdinalPosition: 1, Nested: nested{SizeBytes: 1024}}
+	b := example{Name: "t", OrdinalPosition: 1, Nested: nested{SizeBytes: 2048}}
+
+	fingerprintA := schemaFingerprint(a).(example)
+	fingerprintB := schemaFingerprint(b).(example)
+
+	if fingerprintA != fingerprintB {
+		t.Fatalf("expected fingerprints to match once the known live-stat field is stripped, got %+v vs %+v", fingerprintA, fingerprintB)
+	}
+
+	c := example{Name: "t", OrdinalPosition: 2, Nested: nested{SizeBytes: 1024}}
+	if schemaFingerprint(a).(example) == schemaFingerprint(c).(example) {
+		t.Fatal("expected a change to a non-allow-listed numeric DDL field to still be detected")
+	}
+}
@@ -0,0 +1,53 @@
+package schemadiff
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func snapshotPath(dir string, serverID string, databaseOid int) string {
+	return filepath.Join(dir, serverID, fmt.Sprintf("%d.json", databaseOid))
+}
+
+// Load - Reads back the schema persisted by the previous successful
+// collection for this server/database, if any
+func Load(dir string, serverID string, databaseOid int) (schema Schema, found bool, err error) {
+	data, err := ioutil.ReadFile(snapshotPath(dir, serverID, databaseOid))
+	if os.IsNotExist(err) {
+		return Schema{}, false, nil
+	}
+	if err != nil {
+		return Schema{}, false, err
+	}
+
+	err = json.Unmarshal(data, &schema)
+	if err != nil {
+		return Schema{}, false, err
+	}
+
+	return schema, true, nil
+}
+
+// Save - Persists the schema from the most recent successful collection, so
+// the next run can diff against it
+func Save(dir string, serverID string, databaseOid int, schema Schema) error {
+	path := snapshotPath(dir, serverID, databaseOid)
+
+	// The persisted schema includes column/function definitions and settings
+	// values, so keep both the directory and the file readable only by the
+	// user running the collector.
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,42 @@
+// Package setup implements a guided, idempotent wizard for preparing a
+// PostgreSQL server and host for monitoring by the pganalyze collector.
+package setup
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/pganalyze/collector/config"
+	"github.com/pganalyze/collector/setup/steps"
+	"github.com/pganalyze/collector/util"
+)
+
+// Run - Walks the user through each setup step in order, skipping any whose
+// Check reports that it is already satisfied.
+func Run(logger *util.Logger, cfg config.DatabaseConfig, db *pgxpool.Pool, configFilename string) error {
+	state := &steps.State{
+		Logger:         logger,
+		Config:         cfg,
+		DB:             db,
+		ConfigFilename: configFilename,
+	}
+
+	for _, step := range steps.All {
+		ok, err := step.Check(state)
+		if err != nil {
+			return err
+		}
+		if ok {
+			logger.PrintVerbose("[%s] %s - already satisfied, skipping", step.ID, step.Description)
+			continue
+		}
+
+		logger.PrintInfo("[%s] %s", step.ID, step.Description)
+		err = step.Run(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.PrintInfo("Setup complete")
+	return nil
+}
@@ -0,0 +1,28 @@
+package steps
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/pganalyze/collector/config"
+	"github.com/pganalyze/collector/util"
+)
+
+// State - Shared state threaded through the setup steps as the wizard runs
+type State struct {
+	Logger *util.Logger
+	Config config.DatabaseConfig
+	DB     *pgxpool.Pool
+
+	// ConfigFilename is where the resulting .pganalyze_collector.conf will be written
+	ConfigFilename string
+}
+
+// Step - A single, idempotent unit of work in the guided setup wizard. Check
+// reports whether the step's precondition is already satisfied (in which
+// case Run is skipped), and Run performs the work to satisfy it.
+type Step struct {
+	ID          string
+	Description string
+	Check       func(state *State) (bool, error)
+	Run         func(state *State) error
+}
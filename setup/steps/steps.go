@@ -0,0 +1,194 @@
+package steps
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/zcalusic/sysinfo"
+)
+
+// MonitoringRoleName - Name of the restricted role the collector connects as
+const MonitoringRoleName = "pganalyze"
+
+// All - The ordered list of steps the guided setup wizard walks through.
+// Steps are safe to re-run: Check is consulted first and Run is only
+// invoked when the precondition isn't already satisfied.
+var All = []Step{
+	{
+		ID:          "host_info",
+		Description: "Detecting operating system",
+		Check: func(state *State) (bool, error) {
+			return false, nil
+		},
+		Run: func(state *State) error {
+			var si sysinfo.SysInfo
+			si.GetSysInfo()
+			state.Logger.PrintInfo("Detected %s %s (kernel %s)", si.OS.Vendor, si.OS.Version, si.Kernel.Release)
+			return nil
+		},
+	},
+	{
+		ID:          "postgres_version",
+		Description: "Checking PostgreSQL version",
+		Check: func(state *State) (bool, error) {
+			var versionNum int
+			err := state.DB.QueryRow(context.Background(), "SHOW server_version_num").Scan(&versionNum)
+			if err != nil {
+				return false, err
+			}
+			return versionNum >= 90200, nil
+		},
+		Run: func(state *State) error {
+			return fmt.Errorf("your PostgreSQL server version is too old, 9.2 or newer is required")
+		},
+	},
+	{
+		ID:          "shared_preload_libraries",
+		Description: "Checking pg_stat_statements is enabled",
+		Check: func(state *State) (bool, error) {
+			var preloadLibraries string
+			err := state.DB.QueryRow(context.Background(), "SHOW shared_preload_libraries").Scan(&preloadLibraries)
+			if err != nil {
+				return false, err
+			}
+			for _, lib := range strings.Split(preloadLibraries, ",") {
+				if strings.TrimSpace(lib) == "pg_stat_statements" {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		Run: func(state *State) error {
+			return fmt.Errorf("pg_stat_statements is not in shared_preload_libraries - add it and restart PostgreSQL, then re-run setup")
+		},
+	},
+	{
+		ID:          "monitoring_role",
+		Description: "Creating pganalyze monitoring role",
+		Check: func(state *State) (bool, error) {
+			var exists bool
+			err := state.DB.QueryRow(context.Background(), "SELECT true FROM pg_roles WHERE rolname = $1", MonitoringRoleName).Scan(&exists)
+			if err == pgx.ErrNoRows {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return exists, nil
+		},
+		Run: func(state *State) error {
+			_, err := state.DB.Exec(context.Background(), fmt.Sprintf("CREATE ROLE %s WITH LOGIN", MonitoringRoleName))
+			if err != nil {
+				return err
+			}
+
+			var versionNum int
+			err = state.DB.QueryRow(context.Background(), "SHOW server_version_num").Scan(&versionNum)
+			if err != nil {
+				return err
+			}
+
+			if versionNum >= 100000 {
+				// pg_monitor is the predefined role that covers everything the
+				// collector needs, but it only exists from PostgreSQL 10 onwards.
+				_, err = state.DB.Exec(context.Background(), fmt.Sprintf("GRANT pg_monitor TO %s", MonitoringRoleName))
+				if err != nil {
+					return err
+				}
+			} else {
+				// No pg_monitor equivalent on 9.2-9.6, so grant the individual
+				// privileges it would otherwise cover.
+				_, err = state.DB.Exec(context.Background(), fmt.Sprintf("GRANT SELECT ON pg_stat_activity, pg_stat_replication TO %s", MonitoringRoleName))
+				if err != nil {
+					return err
+				}
+				_, err = state.DB.Exec(context.Background(), fmt.Sprintf("GRANT EXECUTE ON FUNCTION pg_stat_file(text) TO %s", MonitoringRoleName))
+				if err != nil {
+					return err
+				}
+			}
+
+			state.Logger.PrintInfo("Created monitoring role \"%s\" - remember to set a password before using it", MonitoringRoleName)
+			return nil
+		},
+	},
+	{
+		ID:          "pg_stat_statements_extension",
+		Description: "Enabling pg_stat_statements extension",
+		Check: func(state *State) (bool, error) {
+			var exists bool
+			err := state.DB.QueryRow(context.Background(), "SELECT true FROM pg_extension WHERE extname = 'pg_stat_statements'").Scan(&exists)
+			if err == pgx.ErrNoRows {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return exists, nil
+		},
+		Run: func(state *State) error {
+			_, err := state.DB.Exec(context.Background(), "CREATE EXTENSION IF NOT EXISTS pg_stat_statements")
+			return err
+		},
+	},
+	{
+		ID:          "stats_helper",
+		Description: "Installing pganalyze.get_stat_statements() stats helper",
+		Check: func(state *State) (bool, error) {
+			var enabled bool
+			err := state.DB.QueryRow(context.Background(), `
+				SELECT true
+				  FROM pg_proc
+				  JOIN pg_namespace ON (pronamespace = pg_namespace.oid)
+				 WHERE nspname = 'pganalyze' AND proname = 'get_stat_statements'
+			`).Scan(&enabled)
+			if err == pgx.ErrNoRows {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return enabled, nil
+		},
+		Run: func(state *State) error {
+			_, err := state.DB.Exec(context.Background(), "CREATE SCHEMA IF NOT EXISTS pganalyze")
+			if err != nil {
+				return err
+			}
+			_, err = state.DB.Exec(context.Background(), `
+				CREATE OR REPLACE FUNCTION pganalyze.get_stat_statements()
+				RETURNS SETOF pg_stat_statements AS
+				$$
+					SELECT * FROM public.pg_stat_statements;
+				$$ LANGUAGE sql VOLATILE SECURITY DEFINER
+			`)
+			if err != nil {
+				return err
+			}
+			_, err = state.DB.Exec(context.Background(), fmt.Sprintf("GRANT EXECUTE ON FUNCTION pganalyze.get_stat_statements() TO %s", MonitoringRoleName))
+			return err
+		},
+	},
+	{
+		ID:          "write_config",
+		Description: "Writing .pganalyze_collector.conf",
+		Check: func(state *State) (bool, error) {
+			_, err := os.Stat(state.ConfigFilename)
+			return err == nil, nil
+		},
+		Run: func(state *State) error {
+			contents := fmt.Sprintf(`[%s]
+db_host = %s
+db_port = %d
+db_name = %s
+db_username = %s
+api_key = %s
+`, state.Config.SectionName, state.Config.DbHost, state.Config.DbPort, state.Config.DbName, MonitoringRoleName, state.Config.APIKey)
+
+			return os.WriteFile(state.ConfigFilename, []byte(contents), 0600)
+		},
+	},
+}
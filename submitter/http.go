@@ -0,0 +1,54 @@
+package submitter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPSubmitter - Submits snapshots to the pganalyze API, the way the
+// collector always has
+type HTTPSubmitter struct {
+	APIURL string
+	APIKey string
+}
+
+// Submit - Posts the compressed snapshot to the configured pganalyze API endpoint
+func (s HTTPSubmitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	form := url.Values{
+		"data":               {string(compressed)},
+		"data_compressor":    {meta.DataCompressor},
+		"api_key":            {s.APIKey},
+		"submitter":          {"pganalyze-collector 0.9.0rc2"},
+		"system_information": {"false"},
+		"no_reset":           {"true"},
+		"query_source":       {"pg_stat_statements"},
+		"collected_at":       {fmt.Sprintf("%d", meta.CollectedAt)},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.APIURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error when submitting: %s", body)
+	}
+
+	return nil
+}
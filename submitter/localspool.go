@@ -0,0 +1,26 @@
+package submitter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// LocalSpoolSubmitter - Writes snapshots to a local directory instead of
+// submitting them over the network, for air-gapped installations
+type LocalSpoolSubmitter struct {
+	Directory string
+}
+
+// Submit - Writes the compressed snapshot to <Directory>/<ObjectKey>
+func (s LocalSpoolSubmitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	path := filepath.Join(s.Directory, ObjectKey(meta))
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, compressed, 0644)
+}
@@ -0,0 +1,69 @@
+package submitter
+
+import (
+	"bytes"
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Submitter - Uploads snapshots to an S3 bucket, for air-gapped or
+// self-managed setups that don't submit directly to the pganalyze API
+type S3Submitter struct {
+	Bucket   string
+	Uploader *s3manager.Uploader
+}
+
+// NewS3Submitter - Builds an S3Submitter for the given bucket/region
+func NewS3Submitter(bucket string, region string) (S3Submitter, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return S3Submitter{}, err
+	}
+
+	return S3Submitter{Bucket: bucket, Uploader: s3manager.NewUploader(sess)}, nil
+}
+
+// Submit - Uploads the compressed snapshot to S3, keyed by server/date/time
+func (s S3Submitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	key := ObjectKey(meta)
+
+	_, err := s.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(compressed),
+	})
+	return err
+}
+
+// GCSSubmitter - Uploads snapshots to a Google Cloud Storage bucket
+type GCSSubmitter struct {
+	Bucket string
+	Client *storage.Client
+}
+
+// NewGCSSubmitter - Builds a GCSSubmitter for the given bucket, using application default credentials
+func NewGCSSubmitter(ctx context.Context, bucket string) (GCSSubmitter, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return GCSSubmitter{}, err
+	}
+
+	return GCSSubmitter{Bucket: bucket, Client: client}, nil
+}
+
+// Submit - Uploads the compressed snapshot to GCS, keyed by server/date/time
+func (s GCSSubmitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	key := ObjectKey(meta)
+
+	w := s.Client.Bucket(s.Bucket).Object(key).NewWriter(ctx)
+	if _, err := w.Write(compressed); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,126 @@
+package submitter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pganalyze/collector/util"
+)
+
+// queuedSubmission - On-disk representation of a snapshot that couldn't be
+// submitted yet, so it can be retried on a later scheduler tick
+type queuedSubmission struct {
+	Compressed []byte         `json:"compressed"`
+	Meta       SubmissionMeta `json:"meta"`
+}
+
+// RetryingSubmitter - Wraps another SnapshotSubmitter with retry/backoff, and
+// persists snapshots that still fail to a local queue directory so they are
+// retried on the next scheduler tick instead of being dropped
+type RetryingSubmitter struct {
+	Inner       SnapshotSubmitter
+	QueueDir    string
+	MaxAttempts int
+	Logger      *util.Logger
+}
+
+// NewRetryingSubmitter - Wraps inner with a default retry/backoff policy and queue directory
+func NewRetryingSubmitter(inner SnapshotSubmitter, queueDir string, logger *util.Logger) RetryingSubmitter {
+	return RetryingSubmitter{Inner: inner, QueueDir: queueDir, MaxAttempts: 3, Logger: logger}
+}
+
+// Submit - Attempts delivery with exponential backoff; on persistent failure,
+// the snapshot is spooled to QueueDir instead of being lost
+func (s RetryingSubmitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	var err error
+
+	backoff := time.Second
+	for attempt := 1; attempt <= s.MaxAttempts; attempt++ {
+		err = s.Inner.Submit(ctx, compressed, meta)
+		if err == nil {
+			return nil
+		}
+
+		s.Logger.PrintVerbose("Submission attempt %d/%d failed: %s", attempt, s.MaxAttempts, err)
+		if attempt < s.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	s.Logger.PrintError("Could not submit snapshot after %d attempts, queuing for retry: %s", s.MaxAttempts, err)
+
+	enqueueErr := s.enqueue(compressed, meta)
+	if enqueueErr != nil {
+		s.Logger.PrintError("Could not queue snapshot for retry: %s", enqueueErr)
+	}
+
+	// Submission itself still failed - the caller (and its logs) must see
+	// that, regardless of whether we managed to queue the payload for a
+	// later retry, or callers would report success for data that was never
+	// delivered.
+	return err
+}
+
+func (s RetryingSubmitter) enqueue(compressed []byte, meta SubmissionMeta) error {
+	// Queued snapshots contain the full collected payload (query text, logs,
+	// schema/function bodies, GUC values), so keep both the directory and
+	// the file itself readable only by the user running the collector.
+	err := os.MkdirAll(s.QueueDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	queued := queuedSubmission{Compressed: compressed, Meta: meta}
+	data, err := json.Marshal(queued)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.QueueDir, time.Now().Format("20060102T150405.000000000")+".json")
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// RetryQueued - Attempts to submit any snapshots left over from previous
+// failed submissions. Intended to be called once per scheduler tick before
+// (or instead of) a fresh collection, so a backlog drains over time.
+func (s RetryingSubmitter) RetryQueued(ctx context.Context) error {
+	entries, err := ioutil.ReadDir(s.QueueDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(s.QueueDir, entry.Name())
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			s.Logger.PrintError("Could not read queued submission %s: %s", path, err)
+			continue
+		}
+
+		var queued queuedSubmission
+		err = json.Unmarshal(data, &queued)
+		if err != nil {
+			s.Logger.PrintError("Could not decode queued submission %s: %s", path, err)
+			continue
+		}
+
+		err = s.Inner.Submit(ctx, queued.Compressed, queued.Meta)
+		if err != nil {
+			s.Logger.PrintVerbose("Queued submission %s still failing: %s", path, err)
+			continue
+		}
+
+		os.Remove(path)
+	}
+
+	return nil
+}
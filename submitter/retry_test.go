@@ -0,0 +1,84 @@
+package submitter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/pganalyze/collector/util"
+)
+
+type fakeSubmitter struct {
+	err    error
+	submit []SubmissionMeta
+}
+
+func (f *fakeSubmitter) Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error {
+	f.submit = append(f.submit, meta)
+	return f.err
+}
+
+func testLogger() *util.Logger {
+	return &util.Logger{Destination: log.New(ioutil.Discard, "", 0)}
+}
+
+func TestSubmitReturnsRealErrorEvenAfterSuccessfulEnqueue(t *testing.T) {
+	inner := &fakeSubmitter{err: errors.New("api key rejected")}
+	s := NewRetryingSubmitter(inner, t.TempDir(), testLogger())
+	s.MaxAttempts = 1
+
+	err := s.Submit(context.Background(), []byte("data"), SubmissionMeta{ServerID: "prod-db"})
+	if err == nil {
+		t.Fatal("expected Submit to return the submission error, got nil")
+	}
+	if err.Error() != "api key rejected" {
+		t.Fatalf("expected the original submission error to surface, got: %s", err)
+	}
+}
+
+func TestSubmitQueuesOnPersistentFailure(t *testing.T) {
+	inner := &fakeSubmitter{err: errors.New("unreachable")}
+	queueDir := t.TempDir()
+	s := NewRetryingSubmitter(inner, queueDir, testLogger())
+	s.MaxAttempts = 1
+
+	_ = s.Submit(context.Background(), []byte("data"), SubmissionMeta{ServerID: "prod-db"})
+
+	entries, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		t.Fatalf("could not read queue dir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one queued submission, got %d", len(entries))
+	}
+}
+
+func TestRetryQueuedDrainsOnSuccess(t *testing.T) {
+	queueDir := t.TempDir()
+
+	failing := &fakeSubmitter{err: errors.New("down")}
+	s := NewRetryingSubmitter(failing, queueDir, testLogger())
+	s.MaxAttempts = 1
+	_ = s.Submit(context.Background(), []byte("data"), SubmissionMeta{ServerID: "prod-db"})
+
+	succeeding := &fakeSubmitter{}
+	s.Inner = succeeding
+
+	err := s.RetryQueued(context.Background())
+	if err != nil {
+		t.Fatalf("RetryQueued returned error: %s", err)
+	}
+	if len(succeeding.submit) != 1 {
+		t.Fatalf("expected the queued submission to be retried once, got %d", len(succeeding.submit))
+	}
+
+	entries, err := ioutil.ReadDir(queueDir)
+	if err != nil {
+		t.Fatalf("could not read queue dir: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the queue to be drained, still have %d entries", len(entries))
+	}
+}
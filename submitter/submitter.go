@@ -0,0 +1,33 @@
+// Package submitter delivers compressed collector snapshots to their
+// configured destination - the pganalyze API, an S3/GCS bucket, or a local
+// spool directory - and retries transient failures instead of dropping them.
+package submitter
+
+import (
+	"context"
+	"time"
+)
+
+// SubmissionMeta - Metadata describing a single snapshot submission, passed
+// to every SnapshotSubmitter implementation alongside the compressed payload
+type SubmissionMeta struct {
+	ServerID       string
+	CollectedAt    int64
+	DataCompressor string
+}
+
+// SnapshotSubmitter - Delivers a compressed snapshot to its destination
+type SnapshotSubmitter interface {
+	Submit(ctx context.Context, compressed []byte, meta SubmissionMeta) error
+}
+
+// ObjectKey - Builds the "server-id/YYYY/MM/DD/HHMMSS.json.zst"-style key
+// object-store and spool submitters file each snapshot under
+func ObjectKey(meta SubmissionMeta) string {
+	t := time.Unix(meta.CollectedAt, 0).UTC()
+	ext := "json.zst"
+	if meta.DataCompressor == "zlib" {
+		ext = "json.zlib"
+	}
+	return meta.ServerID + "/" + t.Format("2006/01/02/150405") + "." + ext
+}
@@ -0,0 +1,23 @@
+package submitter
+
+import "testing"
+
+func TestObjectKey(t *testing.T) {
+	meta := SubmissionMeta{ServerID: "prod-db", CollectedAt: 1700000000, DataCompressor: "zstd"}
+
+	got := ObjectKey(meta)
+	want := "prod-db/2023/11/14/221320.json.zst"
+	if got != want {
+		t.Fatalf("ObjectKey() = %q, want %q", got, want)
+	}
+}
+
+func TestObjectKeyZlibExtension(t *testing.T) {
+	meta := SubmissionMeta{ServerID: "prod-db", CollectedAt: 1700000000, DataCompressor: "zlib"}
+
+	got := ObjectKey(meta)
+	want := "prod-db/2023/11/14/221320.json.zlib"
+	if got != want {
+		t.Fatalf("ObjectKey() = %q, want %q", got, want)
+	}
+}